@@ -0,0 +1,283 @@
+package state
+
+import (
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+)
+
+// storageSlot caches the first-seen original value alongside the latest
+// written value, so Commit can replay a single WriteAccountStorage call that
+// still hits StateWriterV4's original.Eq(value) early exit correctly.
+type storageSlot struct {
+	original *uint256.Int
+	value    *uint256.Int
+	read     bool // true if value came from a read, not yet overwritten by a write
+}
+
+// CachedStateReadWriter sits in front of a StateReaderV4/StateWriterV4 pair
+// and memoizes LatestAccount/LatestStorage/LatestCode-shaped reads for the
+// lifetime of a single transaction or block, buffering writes into a local
+// map that is only applied to the underlying writer on Commit. This avoids
+// round-tripping into SharedDomains on every SLOAD/BALANCE/EXTCODESIZE for
+// hot contracts touched repeatedly within the same transaction.
+type CachedStateReadWriter struct {
+	reader StateReader
+	writer StateWriter
+
+	accounts     map[common.Address]*accounts.Account // nil entry means known absent
+	accountsSeen map[common.Address]bool
+	code         map[common.Address][]byte
+	codeSeen     map[common.Address]bool
+	storage      map[common.Address]map[common.Hash]*storageSlot
+
+	pendingAccounts map[common.Address]*pendingAccount
+	pendingCode     map[common.Address]*pendingCode
+
+	// clearedStorage/clearedCode mark an address whose storage/code
+	// namespace was wiped by DeleteAccount or CreateContract but whose
+	// write hasn't reached the underlying writer yet (it's only buffered
+	// until Commit). Without them, a read that misses the now-empty
+	// per-address map would fall through to c.reader and resurrect the
+	// pre-delete value instead of observing the wipe.
+	clearedStorage map[common.Address]bool
+	clearedCode    map[common.Address]bool
+
+	hits, misses uint64
+}
+
+// pendingAccount buffers every account-shaped write Commit must flush for an
+// address, in the order they need to reach the underlying writer: a delete
+// (if any) must land before a later recreate, and a CreateContract before
+// the UpdateAccountData that follows it — even though DeleteAccount and
+// CreateContract on CachedStateReadWriter only buffer here rather than
+// writing through immediately.
+type pendingAccount struct {
+	original *accounts.Account
+	account  *accounts.Account
+
+	deleted         bool
+	deletedOriginal *accounts.Account
+	created         bool
+}
+
+type pendingCode struct {
+	incarnation uint64
+	codeHash    common.Hash
+	code        []byte
+}
+
+// NewCachedStateReadWriter wraps reader/writer with a per-transaction cache.
+func NewCachedStateReadWriter(reader StateReader, writer StateWriter) *CachedStateReadWriter {
+	return &CachedStateReadWriter{
+		reader:          reader,
+		writer:          writer,
+		accounts:        make(map[common.Address]*accounts.Account),
+		accountsSeen:    make(map[common.Address]bool),
+		code:            make(map[common.Address][]byte),
+		codeSeen:        make(map[common.Address]bool),
+		storage:         make(map[common.Address]map[common.Hash]*storageSlot),
+		pendingAccounts: make(map[common.Address]*pendingAccount),
+		pendingCode:     make(map[common.Address]*pendingCode),
+		clearedStorage:  make(map[common.Address]bool),
+		clearedCode:     make(map[common.Address]bool),
+	}
+}
+
+// Hits returns the number of reads served from the cache.
+func (c *CachedStateReadWriter) Hits() uint64 { return c.hits }
+
+// Misses returns the number of account, storage and code reads that had to
+// fall through to the wrapped StateReader. ReadAccountIncarnation is not
+// cached and is counted neither as a hit nor as a miss.
+func (c *CachedStateReadWriter) Misses() uint64 { return c.misses }
+
+func (c *CachedStateReadWriter) ReadAccountData(address common.Address) (*accounts.Account, error) {
+	if c.accountsSeen[address] {
+		c.hits++
+		return c.accounts[address], nil
+	}
+	c.misses++
+	a, err := c.reader.ReadAccountData(address)
+	if err != nil {
+		return nil, err
+	}
+	c.accounts[address] = a
+	c.accountsSeen[address] = true
+	return a, nil
+}
+
+func (c *CachedStateReadWriter) ReadAccountStorage(address common.Address, incarnation uint64, key *common.Hash) ([]byte, error) {
+	if slots, ok := c.storage[address]; ok {
+		if slot, ok := slots[*key]; ok {
+			c.hits++
+			return slot.value.Bytes(), nil
+		}
+	}
+	if c.clearedStorage[address] {
+		c.hits++
+		return nil, nil
+	}
+	c.misses++
+	enc, err := c.reader.ReadAccountStorage(address, incarnation, key)
+	if err != nil {
+		return nil, err
+	}
+	value := new(uint256.Int).SetBytes(enc)
+	c.cacheStorage(address, *key, value, value, true)
+	return enc, nil
+}
+
+func (c *CachedStateReadWriter) cacheStorage(address common.Address, key common.Hash, original, value *uint256.Int, read bool) {
+	slots, ok := c.storage[address]
+	if !ok {
+		slots = make(map[common.Hash]*storageSlot)
+		c.storage[address] = slots
+	}
+	if existing, found := slots[key]; found {
+		existing.value = value
+		existing.read = existing.read && read
+	} else {
+		slots[key] = &storageSlot{original: original, value: value, read: read}
+	}
+}
+
+func (c *CachedStateReadWriter) ReadAccountCode(address common.Address, incarnation uint64, codeHash common.Hash) ([]byte, error) {
+	if c.codeSeen[address] {
+		c.hits++
+		return c.code[address], nil
+	}
+	if c.clearedCode[address] {
+		c.hits++
+		return nil, nil
+	}
+	c.misses++
+	code, err := c.reader.ReadAccountCode(address, incarnation, codeHash)
+	if err != nil {
+		return nil, err
+	}
+	c.code[address] = code
+	c.codeSeen[address] = true
+	return code, nil
+}
+
+func (c *CachedStateReadWriter) ReadAccountCodeSize(address common.Address, incarnation uint64, codeHash common.Hash) (int, error) {
+	code, err := c.ReadAccountCode(address, incarnation, codeHash)
+	if err != nil {
+		return 0, err
+	}
+	return len(code), nil
+}
+
+func (c *CachedStateReadWriter) ReadAccountIncarnation(address common.Address) (uint64, error) {
+	return c.reader.ReadAccountIncarnation(address)
+}
+
+func (c *CachedStateReadWriter) UpdateAccountData(address common.Address, original, account *accounts.Account) error {
+	if p, ok := c.pendingAccounts[address]; ok {
+		p.account = account
+	} else {
+		c.pendingAccounts[address] = &pendingAccount{original: original, account: account}
+	}
+	c.accounts[address] = account
+	c.accountsSeen[address] = true
+	return nil
+}
+
+func (c *CachedStateReadWriter) UpdateAccountCode(address common.Address, incarnation uint64, codeHash common.Hash, code []byte) error {
+	c.pendingCode[address] = &pendingCode{incarnation: incarnation, codeHash: codeHash, code: code}
+	c.code[address] = code
+	c.codeSeen[address] = true
+	return nil
+}
+
+func (c *CachedStateReadWriter) DeleteAccount(address common.Address, original *accounts.Account) error {
+	if p, ok := c.pendingAccounts[address]; ok {
+		p.account = nil
+		p.deleted = true
+		p.deletedOriginal = original
+	} else {
+		c.pendingAccounts[address] = &pendingAccount{original: original, account: nil, deleted: true, deletedOriginal: original}
+	}
+	c.accounts[address] = nil
+	c.accountsSeen[address] = true
+	delete(c.storage, address)
+	delete(c.code, address)
+	delete(c.codeSeen, address)
+	delete(c.pendingCode, address)
+	c.clearedStorage[address] = true
+	c.clearedCode[address] = true
+	return nil
+}
+
+func (c *CachedStateReadWriter) WriteAccountStorage(address common.Address, incarnation uint64, key *common.Hash, original, value *uint256.Int) error {
+	if original.Eq(value) {
+		return nil
+	}
+	c.cacheStorage(address, *key, original, value, false)
+	return nil
+}
+
+// CreateContract invalidates any cached storage and code namespace for
+// address, since a freshly created contract cannot inherit a prior
+// incarnation's slots or code. The underlying CreateContract call is
+// buffered to Commit, like every other account write, so it lands in the
+// right order relative to a buffered DeleteAccount/UpdateAccountData for the
+// same address rather than writing through ahead of them.
+func (c *CachedStateReadWriter) CreateContract(address common.Address) error {
+	delete(c.storage, address)
+	delete(c.code, address)
+	delete(c.codeSeen, address)
+	delete(c.pendingCode, address)
+	c.clearedStorage[address] = true
+	c.clearedCode[address] = true
+	if p, ok := c.pendingAccounts[address]; ok {
+		p.created = true
+	} else {
+		c.pendingAccounts[address] = &pendingAccount{created: true}
+	}
+	return nil
+}
+
+// Commit flushes every buffered write to the wrapped StateWriter. Storage
+// writes replay the first-seen original value together with the latest
+// value, so the underlying writer's original.Eq(value) early exit still
+// applies across the whole transaction rather than per individual write.
+func (c *CachedStateReadWriter) Commit() error {
+	for address, p := range c.pendingAccounts {
+		if p.deleted {
+			if err := c.writer.DeleteAccount(address, p.deletedOriginal); err != nil {
+				return err
+			}
+		}
+		if p.created {
+			if err := c.writer.CreateContract(address); err != nil {
+				return err
+			}
+		}
+		if p.account == nil {
+			continue
+		}
+		if err := c.writer.UpdateAccountData(address, p.original, p.account); err != nil {
+			return err
+		}
+	}
+	for address, p := range c.pendingCode {
+		if err := c.writer.UpdateAccountCode(address, p.incarnation, p.codeHash, p.code); err != nil {
+			return err
+		}
+	}
+	for address, slots := range c.storage {
+		for key, slot := range slots {
+			if slot.read {
+				continue
+			}
+			k := key
+			if err := c.writer.WriteAccountStorage(address, 0, &k, slot.original, slot.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ledgerwatch/log/v3"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/metrics"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+)
+
+// DivergenceKind identifies which read method produced a divergence, so a
+// DivergenceSink can tell BALANCE mismatches apart from storage or code ones.
+type DivergenceKind string
+
+const (
+	DivergenceAccount     DivergenceKind = "account"
+	DivergenceStorage     DivergenceKind = "storage"
+	DivergenceCode        DivergenceKind = "code"
+	DivergenceCodeSize    DivergenceKind = "code_size"
+	DivergenceIncarnation DivergenceKind = "incarnation"
+)
+
+// DivergenceSink is notified every time MultiStateReader observes a reader
+// disagreeing with the ethalon (first) reader's value. Implementations
+// should not block the read path for long; they are called synchronously
+// from the reader that detected the mismatch.
+type DivergenceSink interface {
+	OnAccountDivergence(address common.Address, readerIdx int, readerType string, expected, actual *accounts.Account)
+	OnStorageDivergence(address common.Address, key common.Hash, readerIdx int, readerType string, expected, actual []byte)
+	OnCodeDivergence(address common.Address, readerIdx int, readerType string, expected, actual []byte)
+	OnCodeSizeDivergence(address common.Address, readerIdx int, readerType string, expected, actual int)
+	OnIncarnationDivergence(address common.Address, readerIdx int, readerType string, expected, actual uint64)
+}
+
+// DivergenceError is returned by MultiStateReader in strict mode instead of
+// the ethalon reader's value, so a caller cannot silently proceed on state
+// that the readers disagree about.
+type DivergenceError struct {
+	Kind       DivergenceKind
+	Address    common.Address
+	ReaderIdx  int
+	ReaderType string
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("state divergence: %s addr=%s reader=%d(%s)", e.Kind, e.Address, e.ReaderIdx, e.ReaderType)
+}
+
+// divergenceRecord is the serialised form written by FileDivergenceSink.
+type divergenceRecord struct {
+	Kind       DivergenceKind `json:"kind"`
+	Address    string         `json:"address"`
+	Key        string         `json:"key,omitempty"`
+	ReaderIdx  int            `json:"reader_idx"`
+	ReaderType string         `json:"reader_type"`
+	Expected   string         `json:"expected"`
+	Actual     string         `json:"actual"`
+}
+
+// FileDivergenceSink appends one JSON record per divergence to a rotating
+// log file. It is safe for concurrent use.
+type FileDivergenceSink struct {
+	mu  sync.Mutex
+	out *lumberjack.Logger
+	enc *json.Encoder
+}
+
+// NewFileDivergenceSink opens (or creates) path as a rotating log file,
+// keeping up to maxBackups rotated files of maxSizeMB each.
+func NewFileDivergenceSink(path string, maxSizeMB, maxBackups int) *FileDivergenceSink {
+	out := &lumberjack.Logger{Filename: path, MaxSize: maxSizeMB, MaxBackups: maxBackups}
+	return &FileDivergenceSink{out: out, enc: json.NewEncoder(out)}
+}
+
+func (s *FileDivergenceSink) write(rec divergenceRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(rec); err != nil {
+		log.Warn("divergence sink: write failed", "err", err)
+	}
+}
+
+func (s *FileDivergenceSink) OnAccountDivergence(address common.Address, readerIdx int, readerType string, expected, actual *accounts.Account) {
+	s.write(divergenceRecord{Kind: DivergenceAccount, Address: address.String(), ReaderIdx: readerIdx, ReaderType: readerType,
+		Expected: fmt.Sprintf("%+v", expected), Actual: fmt.Sprintf("%+v", actual)})
+}
+
+func (s *FileDivergenceSink) OnStorageDivergence(address common.Address, key common.Hash, readerIdx int, readerType string, expected, actual []byte) {
+	s.write(divergenceRecord{Kind: DivergenceStorage, Address: address.String(), Key: key.String(), ReaderIdx: readerIdx, ReaderType: readerType,
+		Expected: fmt.Sprintf("%x", expected), Actual: fmt.Sprintf("%x", actual)})
+}
+
+func (s *FileDivergenceSink) OnCodeDivergence(address common.Address, readerIdx int, readerType string, expected, actual []byte) {
+	s.write(divergenceRecord{Kind: DivergenceCode, Address: address.String(), ReaderIdx: readerIdx, ReaderType: readerType,
+		Expected: fmt.Sprintf("%x", expected), Actual: fmt.Sprintf("%x", actual)})
+}
+
+func (s *FileDivergenceSink) OnCodeSizeDivergence(address common.Address, readerIdx int, readerType string, expected, actual int) {
+	s.write(divergenceRecord{Kind: DivergenceCodeSize, Address: address.String(), ReaderIdx: readerIdx, ReaderType: readerType,
+		Expected: fmt.Sprintf("%d", expected), Actual: fmt.Sprintf("%d", actual)})
+}
+
+func (s *FileDivergenceSink) OnIncarnationDivergence(address common.Address, readerIdx int, readerType string, expected, actual uint64) {
+	s.write(divergenceRecord{Kind: DivergenceIncarnation, Address: address.String(), ReaderIdx: readerIdx, ReaderType: readerType,
+		Expected: fmt.Sprintf("%d", expected), Actual: fmt.Sprintf("%d", actual)})
+}
+
+// PrometheusDivergenceSink counts divergences per kind, so operators can
+// alert on drift between the V4 domain reader and the legacy reader without
+// having to tail the divergence log.
+type PrometheusDivergenceSink struct {
+	counters map[DivergenceKind]metrics.Counter
+}
+
+// NewPrometheusDivergenceSink registers one counter per DivergenceKind under
+// the "state_divergence_total" metric family.
+func NewPrometheusDivergenceSink() *PrometheusDivergenceSink {
+	s := &PrometheusDivergenceSink{counters: make(map[DivergenceKind]metrics.Counter, 5)}
+	for _, kind := range []DivergenceKind{DivergenceAccount, DivergenceStorage, DivergenceCode, DivergenceCodeSize, DivergenceIncarnation} {
+		s.counters[kind] = metrics.GetOrCreateCounter(fmt.Sprintf(`state_divergence_total{kind="%s"}`, kind))
+	}
+	return s
+}
+
+func (s *PrometheusDivergenceSink) OnAccountDivergence(common.Address, int, string, *accounts.Account, *accounts.Account) {
+	s.counters[DivergenceAccount].Inc()
+}
+
+func (s *PrometheusDivergenceSink) OnStorageDivergence(common.Address, common.Hash, int, string, []byte, []byte) {
+	s.counters[DivergenceStorage].Inc()
+}
+
+func (s *PrometheusDivergenceSink) OnCodeDivergence(common.Address, int, string, []byte, []byte) {
+	s.counters[DivergenceCode].Inc()
+}
+
+func (s *PrometheusDivergenceSink) OnCodeSizeDivergence(common.Address, int, string, int, int) {
+	s.counters[DivergenceCodeSize].Inc()
+}
+
+func (s *PrometheusDivergenceSink) OnIncarnationDivergence(common.Address, int, string, uint64, uint64) {
+	s.counters[DivergenceIncarnation].Inc()
+}
+
+// teeDivergenceSink fans out every divergence to all of its sinks.
+type teeDivergenceSink struct {
+	sinks []DivergenceSink
+}
+
+// NewDefaultDivergenceSink returns the sink operators get when they don't
+// configure one explicitly: a rotating JSON file under logPath plus a
+// Prometheus counter sink, so drift between readers both alerts and leaves a
+// reproducer on disk.
+func NewDefaultDivergenceSink(logPath string) DivergenceSink {
+	return &teeDivergenceSink{sinks: []DivergenceSink{
+		NewFileDivergenceSink(logPath, 100, 10),
+		NewPrometheusDivergenceSink(),
+	}}
+}
+
+func (t *teeDivergenceSink) OnAccountDivergence(address common.Address, readerIdx int, readerType string, expected, actual *accounts.Account) {
+	for _, s := range t.sinks {
+		s.OnAccountDivergence(address, readerIdx, readerType, expected, actual)
+	}
+}
+
+func (t *teeDivergenceSink) OnStorageDivergence(address common.Address, key common.Hash, readerIdx int, readerType string, expected, actual []byte) {
+	for _, s := range t.sinks {
+		s.OnStorageDivergence(address, key, readerIdx, readerType, expected, actual)
+	}
+}
+
+func (t *teeDivergenceSink) OnCodeDivergence(address common.Address, readerIdx int, readerType string, expected, actual []byte) {
+	for _, s := range t.sinks {
+		s.OnCodeDivergence(address, readerIdx, readerType, expected, actual)
+	}
+}
+
+func (t *teeDivergenceSink) OnCodeSizeDivergence(address common.Address, readerIdx int, readerType string, expected, actual int) {
+	for _, s := range t.sinks {
+		s.OnCodeSizeDivergence(address, readerIdx, readerType, expected, actual)
+	}
+}
+
+func (t *teeDivergenceSink) OnIncarnationDivergence(address common.Address, readerIdx int, readerType string, expected, actual uint64) {
+	for _, s := range t.sinks {
+		s.OnIncarnationDivergence(address, readerIdx, readerType, expected, actual)
+	}
+}
@@ -20,26 +20,127 @@ import (
 
 type StateWriterV4 struct {
 	*state.SharedDomains
+
+	journal   []journalEntry
+	snapshots int
+}
+
+// journalOpKind identifies which write op a journalEntry undoes, so
+// revertEntry never has to infer the op from which prev* field happens to be
+// non-nil (a fresh contract deploy has a nil prevCode, which is
+// indistinguishable from "this isn't a code entry" under that scheme).
+type journalOpKind int
+
+const (
+	journalAccountUpdate journalOpKind = iota
+	journalAccountDelete
+	journalCodeUpdate
+	journalStorageUpdate
+)
+
+// journalEntry is the inverse of a single write op, replayed by RevertToSnapshot.
+type journalEntry struct {
+	id   int
+	kind journalOpKind
+
+	address common.Address
+	key     *common.Hash // set only for journalStorageUpdate entries
+
+	prevAccount []byte // original serialised account, nil means "account did not exist"
+	prevStorage []byte // original storage value
+	prevCode    []byte // original code, nil means "account had no code"
 }
 
 func WrapStateIO(s *state.SharedDomains) (*StateWriterV4, *StateReaderV4) {
-	w, r := &StateWriterV4{s}, &StateReaderV4{s}
+	w, r := &StateWriterV4{SharedDomains: s}, &StateReaderV4{s}
 	return w, r
 }
 
+// Snapshot returns an identifier that can later be passed to RevertToSnapshot
+// to undo every write made after this call, mirroring go-ethereum's
+// state.Snapshot()/RevertToSnapshot used by eth_call/gas estimation.
+//
+// Writes are only journaled while a snapshot is live (see journalEntry), and
+// a write's generation is the current value of w.snapshots at the time it
+// happens. Because Snapshot bumps w.snapshots before returning, every write
+// made after Snapshot returned id carries a generation strictly greater than
+// id, so nested snapshots revert independently of each other.
+func (w *StateWriterV4) Snapshot() int {
+	id := w.snapshots
+	w.snapshots++
+	return id
+}
+
+// RevertToSnapshot undoes all writes recorded since Snapshot returned id, by
+// replaying the journaled inverse operations back into the domains.
+func (w *StateWriterV4) RevertToSnapshot(id int) error {
+	for len(w.journal) > 0 {
+		entry := w.journal[len(w.journal)-1]
+		if entry.id <= id {
+			break
+		}
+		if err := w.revertEntry(entry); err != nil {
+			return err
+		}
+		w.journal = w.journal[:len(w.journal)-1]
+	}
+	w.snapshots = id
+	return nil
+}
+
+func (w *StateWriterV4) revertEntry(entry journalEntry) error {
+	addressBytes := entry.address.Bytes()
+	switch entry.kind {
+	case journalStorageUpdate:
+		return w.SharedDomains.WriteAccountStorage(addressBytes, entry.key.Bytes(), entry.prevStorage, nil)
+	case journalCodeUpdate:
+		return w.SharedDomains.UpdateAccountCode(addressBytes, entry.prevCode, nil)
+	case journalAccountUpdate, journalAccountDelete:
+		return w.SharedDomains.UpdateAccountData(addressBytes, entry.prevAccount, nil)
+	default:
+		return fmt.Errorf("rw_v4: unknown journal entry kind %d", entry.kind)
+	}
+}
+
+// journalEntry appends the inverse of a write op, but only while a snapshot
+// is live (w.snapshots > 0): writers that never call Snapshot pay nothing.
+func (w *StateWriterV4) journalEntry(address common.Address, key *common.Hash, kind journalOpKind, prevAccount, prevStorage, prevCode []byte) {
+	if w.snapshots == 0 {
+		return
+	}
+	w.journal = append(w.journal, journalEntry{
+		id:          w.snapshots,
+		kind:        kind,
+		address:     address,
+		key:         key,
+		prevAccount: prevAccount,
+		prevStorage: prevStorage,
+		prevCode:    prevCode,
+	})
+}
+
 func (w *StateWriterV4) UpdateAccountData(address common.Address, original, account *accounts.Account) error {
 	//fmt.Printf("account [%x]=>{Balance: %d, Nonce: %d, Root: %x, CodeHash: %x} txNum: %d\n", address, &account.Balance, account.Nonce, account.Root, account.CodeHash, w.txNum)
+	w.journalEntry(address, nil, journalAccountUpdate, accounts.SerialiseV3(original), nil, nil)
 	return w.SharedDomains.UpdateAccountData(address.Bytes(), accounts.SerialiseV3(account), accounts.SerialiseV3(original))
 }
 
 func (w *StateWriterV4) UpdateAccountCode(address common.Address, incarnation uint64, codeHash common.Hash, code []byte) error {
 	//addressBytes, codeHashBytes := address.Bytes(), codeHash.Bytes()
 	//fmt.Printf("code [%x] => [%x] CodeHash: %x, txNum: %d\n", address, code, codeHash, w.txNum)
+	if w.snapshots > 0 {
+		prevCode, err := w.SharedDomains.LatestCode(address.Bytes())
+		if err != nil {
+			return err
+		}
+		w.journalEntry(address, nil, journalCodeUpdate, nil, nil, common.Copy(prevCode))
+	}
 	return w.SharedDomains.UpdateAccountCode(address.Bytes(), code, nil)
 }
 
 func (w *StateWriterV4) DeleteAccount(address common.Address, original *accounts.Account) error {
 	addressBytes := address.Bytes()
+	w.journalEntry(address, nil, journalAccountDelete, accounts.SerialiseV3(original), nil, nil)
 	return w.SharedDomains.DeleteAccount(addressBytes, accounts.SerialiseV3(original))
 }
 
@@ -48,6 +149,7 @@ func (w *StateWriterV4) WriteAccountStorage(address common.Address, incarnation
 		return nil
 	}
 	//fmt.Printf("storage [%x] [%x] => [%x], txNum: %d\n", address, *key, v, w.txNum)
+	w.journalEntry(address, key, journalStorageUpdate, nil, common.Copy(original.Bytes()), nil)
 	return w.SharedDomains.WriteAccountStorage(address.Bytes(), key.Bytes(), value.Bytes(), original.Bytes())
 }
 
@@ -106,6 +208,10 @@ func (s *StateReaderV4) ReadAccountIncarnation(address common.Address) (uint64,
 
 type MultiStateWriter struct {
 	writers []StateWriter
+
+	// snapshots maps a Snapshot() id to the per-writer ids returned by the
+	// wrapped writers that support speculative execution.
+	snapshots [][]int
 }
 
 func NewMultiStateWriter(w ...StateWriter) *MultiStateWriter {
@@ -159,13 +265,64 @@ func (m *MultiStateWriter) CreateContract(address common.Address) error {
 	return nil
 }
 
+// snapshotWriter is implemented by StateWriters that support speculative
+// execution via Snapshot/RevertToSnapshot (e.g. StateWriterV4).
+type snapshotWriter interface {
+	Snapshot() int
+	RevertToSnapshot(id int) error
+}
+
+// Snapshot takes a snapshot on every wrapped writer that supports it and
+// returns the combined id needed to undo all of them together.
+func (m *MultiStateWriter) Snapshot() int {
+	ids := make([]int, len(m.writers))
+	for i, w := range m.writers {
+		if sw, ok := w.(snapshotWriter); ok {
+			ids[i] = sw.Snapshot()
+		}
+	}
+	id := len(m.snapshots)
+	m.snapshots = append(m.snapshots, ids)
+	return id
+}
+
+// RevertToSnapshot reverts every wrapped writer that supports snapshots back
+// to the state it was in when Snapshot() returned id.
+func (m *MultiStateWriter) RevertToSnapshot(id int) error {
+	if id < 0 || id >= len(m.snapshots) {
+		return fmt.Errorf("MultiStateWriter: invalid snapshot id %d", id)
+	}
+	ids := m.snapshots[id]
+	for i, w := range m.writers {
+		sw, ok := w.(snapshotWriter)
+		if !ok {
+			continue
+		}
+		if err := sw.RevertToSnapshot(ids[i]); err != nil {
+			return fmt.Errorf("%T at pos %d: RevertToSnapshot: %w", w, i, err)
+		}
+	}
+	m.snapshots = m.snapshots[:id]
+	return nil
+}
+
 type MultiStateReader struct {
 	readers []StateReader
 	compare bool // use first read as ethalon value for current read iteration
+
+	// Strict makes a divergence between readers a hard error on top of the
+	// log.Warn: the read call returns a *DivergenceError instead of the
+	// ethalon reader's value.
+	Strict bool
+	sink   DivergenceSink
 }
 
-func NewMultiStateReader(compare bool, r ...StateReader) *MultiStateReader {
-	return &MultiStateReader{readers: r, compare: compare}
+// NewMultiStateReader wires up a reader that fans out every read to r and
+// compares them against the first reader's value when compare is true.
+// sink may be nil, in which case divergences are only logged as before; pass
+// NewDefaultDivergenceSink to also persist reproducers and count them.
+func NewMultiStateReader(compare bool, sink DivergenceSink, r ...StateReader) *MultiStateReader {
+	return &MultiStateReader{readers: r, compare: compare, sink: sink}
 }
 func (m *MultiStateReader) ReadAccountData(address common.Address) (*accounts.Account, error) {
 	var vo accounts.Account
@@ -188,13 +345,14 @@ func (m *MultiStateReader) ReadAccountData(address common.Address) (*accounts.Ac
 		}
 		if isnil {
 			if v != nil {
-				log.Warn("state read invalid",
-					"reader", fmt.Sprintf("%d %T", i, r), "addr", address.String(),
-					"m", "nil expected, got something")
-
-			} else {
-				continue
+				if err := m.reportAccountDivergence(i, r, address, nil, v); err != nil {
+					return nil, err
+				}
 			}
+			// Either way the ethalon has no account to diff v's fields
+			// against below: v==nil is not a divergence, v!=nil was
+			// already reported above.
+			continue
 		}
 		buf := new(strings.Builder)
 		if vo.Nonce != v.Nonce {
@@ -210,9 +368,9 @@ func (m *MultiStateReader) ReadAccountData(address common.Address) (*accounts.Ac
 			buf.WriteString(fmt.Sprintf("root exp: %x, %x", vo.Root[:], v.Root[:]))
 		}
 		if buf.Len() > 0 {
-			log.Warn("state read invalid",
-				"reader", fmt.Sprintf("%d %T", i, r), "addr", address.String(),
-				"m", buf.String())
+			if err := m.reportAccountDivergence(i, r, address, &vo, v); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return &vo, nil
@@ -232,9 +390,9 @@ func (m *MultiStateReader) ReadAccountStorage(address common.Address, incarnatio
 			continue
 		}
 		if !bytes.Equal(so, s) {
-			log.Warn("state storage invalid read",
-				"reader", fmt.Sprintf("%d %T", i, r),
-				"addr", address.String(), "loc", key.String(), "expected", so, "got", s)
+			if err := m.reportStorageDivergence(i, r, address, *key, so, s); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return so, nil
@@ -254,9 +412,9 @@ func (m *MultiStateReader) ReadAccountCode(address common.Address, incarnation u
 			continue
 		}
 		if !bytes.Equal(so, s) {
-			log.Warn("state code invalid read",
-				"reader", fmt.Sprintf("%d %T", i, r),
-				"addr", address.String(), "expected", so, "got", s)
+			if err := m.reportCodeDivergence(i, r, address, so, s); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return so, nil
@@ -276,9 +434,9 @@ func (m *MultiStateReader) ReadAccountCodeSize(address common.Address, incarnati
 			continue
 		}
 		if so != s {
-			log.Warn("state code size invalid read",
-				"reader", fmt.Sprintf("%d %T", i, r),
-				"addr", address.String(), "expected", so, "got", s)
+			if err := m.reportCodeSizeDivergence(i, r, address, so, s); err != nil {
+				return 0, err
+			}
 		}
 	}
 	return so, nil
@@ -298,14 +456,81 @@ func (m *MultiStateReader) ReadAccountIncarnation(address common.Address) (uint6
 			continue
 		}
 		if so != s {
-			log.Warn("state incarnation invalid read",
-				"reader", fmt.Sprintf("%d %T", i, r),
-				"addr", address.String(), "expected", so, "got", s)
+			if err := m.reportIncarnationDivergence(i, r, address, so, s); err != nil {
+				return 0, err
+			}
 		}
 	}
 	return so, nil
 }
 
+// reportAccountDivergence logs (and, in strict mode, fails) an account read
+// mismatch between reader i and the ethalon value.
+func (m *MultiStateReader) reportAccountDivergence(i int, r StateReader, address common.Address, expected, actual *accounts.Account) error {
+	log.Warn("state read invalid",
+		"reader", fmt.Sprintf("%d %T", i, r), "addr", address.String(),
+		"expected", expected, "got", actual)
+	if m.sink != nil {
+		m.sink.OnAccountDivergence(address, i, fmt.Sprintf("%T", r), expected, actual)
+	}
+	if m.Strict {
+		return &DivergenceError{Kind: DivergenceAccount, Address: address, ReaderIdx: i, ReaderType: fmt.Sprintf("%T", r)}
+	}
+	return nil
+}
+
+func (m *MultiStateReader) reportStorageDivergence(i int, r StateReader, address common.Address, key common.Hash, expected, actual []byte) error {
+	log.Warn("state storage invalid read",
+		"reader", fmt.Sprintf("%d %T", i, r),
+		"addr", address.String(), "loc", key.String(), "expected", expected, "got", actual)
+	if m.sink != nil {
+		m.sink.OnStorageDivergence(address, key, i, fmt.Sprintf("%T", r), expected, actual)
+	}
+	if m.Strict {
+		return &DivergenceError{Kind: DivergenceStorage, Address: address, ReaderIdx: i, ReaderType: fmt.Sprintf("%T", r)}
+	}
+	return nil
+}
+
+func (m *MultiStateReader) reportCodeDivergence(i int, r StateReader, address common.Address, expected, actual []byte) error {
+	log.Warn("state code invalid read",
+		"reader", fmt.Sprintf("%d %T", i, r),
+		"addr", address.String(), "expected", expected, "got", actual)
+	if m.sink != nil {
+		m.sink.OnCodeDivergence(address, i, fmt.Sprintf("%T", r), expected, actual)
+	}
+	if m.Strict {
+		return &DivergenceError{Kind: DivergenceCode, Address: address, ReaderIdx: i, ReaderType: fmt.Sprintf("%T", r)}
+	}
+	return nil
+}
+
+func (m *MultiStateReader) reportCodeSizeDivergence(i int, r StateReader, address common.Address, expected, actual int) error {
+	log.Warn("state code size invalid read",
+		"reader", fmt.Sprintf("%d %T", i, r),
+		"addr", address.String(), "expected", expected, "got", actual)
+	if m.sink != nil {
+		m.sink.OnCodeSizeDivergence(address, i, fmt.Sprintf("%T", r), expected, actual)
+	}
+	if m.Strict {
+		return &DivergenceError{Kind: DivergenceCodeSize, Address: address, ReaderIdx: i, ReaderType: fmt.Sprintf("%T", r)}
+	}
+	return nil
+}
+
+func (m *MultiStateReader) reportIncarnationDivergence(i int, r StateReader, address common.Address, expected, actual uint64) error {
+	log.Warn("state incarnation invalid read",
+		"reader", fmt.Sprintf("%d %T", i, r),
+		"addr", address.String(), "expected", expected, "got", actual)
+	if m.sink != nil {
+		m.sink.OnIncarnationDivergence(address, i, fmt.Sprintf("%T", r), expected, actual)
+	}
+	if m.Strict {
+		return &DivergenceError{Kind: DivergenceIncarnation, Address: address, ReaderIdx: i, ReaderType: fmt.Sprintf("%T", r)}
+	}
+	return nil
+}
+
 type Update4ReadWriter struct {
 	updates *state.UpdateTree
 
@@ -317,6 +542,33 @@ type Update4ReadWriter struct {
 	domains      *state.SharedDomains
 	writes       []commitment.Update
 	reads        []commitment.Update
+
+	journal   []update4JournalEntry
+	snapshots int
+
+	witness *witnessBuilder
+}
+
+// update4TouchKind identifies which of w.updates' touch functions produced a
+// journal entry, so RevertToSnapshot can replay the correct one.
+type update4TouchKind int
+
+const (
+	update4TouchAccount update4TouchKind = iota
+	update4TouchCode
+	update4TouchStorage
+)
+
+// update4JournalEntry is the inverse of a single TouchPlainKeyDom call,
+// replayed by RevertToSnapshot. hadValue is false when the plain key had no
+// prior update recorded in w.updates, in which case the touch is replayed
+// with a nil value to put the key back into its "untouched" state.
+type update4JournalEntry struct {
+	id        int
+	plainKey  []byte
+	kind      update4TouchKind
+	prevValue []byte
+	hadValue  bool
 }
 
 func NewUpdate4ReadWriter(domains *state.SharedDomains) *Update4ReadWriter {
@@ -329,9 +581,32 @@ func NewUpdate4ReadWriter(domains *state.SharedDomains) *Update4ReadWriter {
 	}
 }
 
+// recordUpdate4Journal saves the current w.updates entry for plainKey (if
+// any) so a later RevertToSnapshot can restore it before a new touch
+// overwrites it. It is a no-op while no snapshot is live (w.snapshots == 0),
+// so writers that never call Snapshot pay nothing.
+func (w *Update4ReadWriter) recordUpdate4Journal(plainKey []byte, kind update4TouchKind) {
+	if w.snapshots == 0 {
+		return
+	}
+	entry := update4JournalEntry{id: w.snapshots, plainKey: common.Copy(plainKey), kind: kind}
+	if item, found := w.updates.Get(plainKey); found {
+		upd := item.Update()
+		entry.hadValue = true
+		switch kind {
+		case update4TouchAccount:
+			entry.prevValue = accounts.SerialiseV3(UpdateToAccount(upd))
+		default:
+			entry.prevValue = common.Copy(upd.CodeHashOrStorage[:upd.ValLength])
+		}
+	}
+	w.journal = append(w.journal, entry)
+}
+
 func (w *Update4ReadWriter) UpdateAccountData(address common.Address, original, account *accounts.Account) error {
 	//fmt.Printf("account [%x]=>{Balance: %d, Nonce: %d, Root: %x, CodeHash: %x} txNum: %d\n", address, &account.Balance, account.Nonce, account.Root, account.CodeHash, w.txNum)
 	//w.updates.TouchPlainKey(address.Bytes(), accounts.SerialiseV3(account), w.updates.TouchAccount)
+	w.recordUpdate4Journal(address.Bytes(), update4TouchAccount)
 	w.updates.TouchPlainKeyDom(w.domains, address.Bytes(), accounts.SerialiseV3(account), w.updates.TouchAccount)
 	return nil
 }
@@ -340,17 +615,62 @@ func (w *Update4ReadWriter) UpdateAccountCode(address common.Address, incarnatio
 	//addressBytes, codeHashBytes := address.Bytes(), codeHash.Bytes()
 	//fmt.Printf("code [%x] => [%x] CodeHash: %x, txNum: %d\n", address, code, codeHash, w.txNum)
 	//w.updates.TouchPlainKey(address.Bytes(), code, w.updates.TouchCode)
+	w.recordUpdate4Journal(address.Bytes(), update4TouchCode)
 	w.updates.TouchPlainKeyDom(w.domains, address.Bytes(), code, w.updates.TouchCode)
+	w.recordCodeWitness(codeHash.Bytes(), code)
 	return nil
 }
 
 func (w *Update4ReadWriter) DeleteAccount(address common.Address, original *accounts.Account) error {
 	addressBytes := address.Bytes()
 	//w.updates.TouchPlainKey(addressBytes, nil, w.updates.TouchAccount)
+	w.recordUpdate4Journal(addressBytes, update4TouchAccount)
 	w.updates.TouchPlainKeyDom(w.domains, addressBytes, nil, w.updates.TouchAccount)
 	return nil
 }
 
+// Snapshot returns an identifier that can later be passed to
+// RevertToSnapshot to undo every TouchPlainKeyDom call made after this call.
+//
+// Touches are only journaled while a snapshot is live, and a touch's
+// generation is the current value of w.snapshots at the time it happens.
+// Because Snapshot bumps w.snapshots before returning, every touch made
+// after Snapshot returned id carries a generation strictly greater than id,
+// so nested snapshots revert independently of each other.
+func (w *Update4ReadWriter) Snapshot() int {
+	id := w.snapshots
+	w.snapshots++
+	return id
+}
+
+// RevertToSnapshot undoes all touches recorded since Snapshot returned id,
+// by replaying the journaled inverse touch into w.updates.
+func (w *Update4ReadWriter) RevertToSnapshot(id int) error {
+	for len(w.journal) > 0 {
+		entry := w.journal[len(w.journal)-1]
+		if entry.id <= id {
+			break
+		}
+		var touchFn func([]byte, []byte) *commitment.Update
+		switch entry.kind {
+		case update4TouchAccount:
+			touchFn = w.updates.TouchAccount
+		case update4TouchCode:
+			touchFn = w.updates.TouchCode
+		case update4TouchStorage:
+			touchFn = w.updates.TouchStorage
+		}
+		var value []byte
+		if entry.hadValue {
+			value = entry.prevValue
+		}
+		w.updates.TouchPlainKeyDom(w.domains, entry.plainKey, value, touchFn)
+		w.journal = w.journal[:len(w.journal)-1]
+	}
+	w.snapshots = id
+	return nil
+}
+
 func (w *Update4ReadWriter) accountFn(plainKey []byte, cell *commitment.Cell) error {
 	item, found := w.updates.Get(plainKey)
 	if found {
@@ -362,7 +682,11 @@ func (w *Update4ReadWriter) accountFn(plainKey []byte, cell *commitment.Cell) er
 			copy(cell.CodeHash[:], upd.CodeHashOrStorage[:])
 		}
 	}
-	return w.domains.AccountFn(plainKey, cell)
+	if err := w.domains.AccountFn(plainKey, cell); err != nil {
+		return err
+	}
+	w.recordAccountWitness(plainKey, cell)
+	return nil
 }
 
 func (w *Update4ReadWriter) storageFn(plainKey []byte, cell *commitment.Cell) error {
@@ -373,50 +697,88 @@ func (w *Update4ReadWriter) storageFn(plainKey []byte, cell *commitment.Cell) er
 		copy(cell.Storage[:], upd.CodeHashOrStorage[:upd.ValLength])
 		cell.Delete = cell.StorageLen == 0
 	}
-	return w.domains.StorageFn(plainKey, cell)
-
+	if err := w.domains.StorageFn(plainKey, cell); err != nil {
+		return err
+	}
+	w.recordStorageWitness(plainKey, cell)
+	return nil
 }
 
 func (w *Update4ReadWriter) branchFn(key []byte) ([]byte, error) {
 	b, ok := w.commitment.Get(string(key))
 	if !ok {
-		return w.domains.BranchFn(key)
+		b, err := w.domains.BranchFn(key)
+		if err != nil {
+			return nil, err
+		}
+		w.recordBranchWitness(key, b)
+		return b, nil
 	}
+	w.recordBranchWitness(key, b)
 	return b, nil
 }
 
-// CommitmentUpdates returns the commitment updates for the current state of w.updates.
-// Commitment is based on sharedDomains commitment tree
-// All branch changes are stored inside Update4ReadWriter in commitment map.
-// Those updates got priority over sharedDomains commitment updates.
-func (w *Update4ReadWriter) CommitmentUpdates() ([]byte, error) {
+// update4Batch is the result of Finalise: w.updates listed as a single
+// sorted plain-key batch, ready to be walked through the patricia trie by
+// AccountsIntermediateRoot.
+type update4Batch struct {
+	keys    [][]byte
+	hashed  [][]byte
+	updates []commitment.Update
+}
+
+// Finalise lists w.updates as a sorted plain-key batch without clearing
+// w.updates. This is the first of the three CommitmentUpdates stages.
+func (w *Update4ReadWriter) Finalise() *update4Batch {
+	plainKeys, hashedKeys, updates := w.updates.List(false)
+	return &update4Batch{keys: plainKeys, hashed: hashedKeys, updates: updates}
+}
+
+// AccountsIntermediateRoot walks every touch in batch (accounts and storage
+// alike) through patricia.ProcessUpdates, which drives w.accountFn/storageFn
+// against w.domains to fill in untouched cells. This is the second of the
+// three CommitmentUpdates stages.
+//
+// This must run on a single goroutine: w.domains is a *state.SharedDomains,
+// and its cursors/buffers are not safe for concurrent use, so accountFn and
+// storageFn can never be driven from two goroutines at once.
+func (w *Update4ReadWriter) AccountsIntermediateRoot(batch *update4Batch) ([]byte, map[string]commitment.BranchData, error) {
 	w.patricia.Reset()
 	w.initPatriciaState.Do(func() {
-		// get commitment state from commitment domain (like we're adding updates to it)
-		stateBytes, err := w.domains.Commitment.PatriciaState()
+		rh, err := w.loadPatriciaState()
 		if err != nil {
 			panic(err)
 		}
-		switch pt := w.patricia.(type) {
-		case *commitment.HexPatriciaHashed:
-			if err := pt.SetState(stateBytes); err != nil {
-				panic(fmt.Errorf("set HPH state: %w", err))
-			}
-			rh, err := pt.RootHash()
-			if err != nil {
-				panic(fmt.Errorf("HPH root hash: %w", err))
-			}
-			fmt.Printf("HPH state set: %x\n", rh)
-		default:
-			panic(fmt.Errorf("unsupported patricia type: %T", pt))
-		}
+		fmt.Printf("HPH state set: %x\n", rh)
 	})
-
 	w.patricia.ResetFns(w.branchFn, w.accountFn, w.storageFn)
-	rh, branches, err := w.patricia.ProcessUpdates(w.updates.List(false))
+
+	return w.patricia.ProcessUpdates(batch.keys, batch.hashed, batch.updates)
+}
+
+// loadPatriciaState sets w.patricia's internal state from the commitment
+// domain's serialized state and returns the resulting root hash, i.e. the
+// actual pre-state root rather than the opaque state blob.
+func (w *Update4ReadWriter) loadPatriciaState() ([]byte, error) {
+	// get commitment state from commitment domain (like we're adding updates to it)
+	stateBytes, err := w.domains.Commitment.PatriciaState()
 	if err != nil {
 		return nil, err
 	}
+	pt, ok := w.patricia.(*commitment.HexPatriciaHashed)
+	if !ok {
+		return nil, fmt.Errorf("unsupported patricia type: %T", w.patricia)
+	}
+	if err := pt.SetState(stateBytes); err != nil {
+		return nil, fmt.Errorf("set HPH state: %w", err)
+	}
+	return pt.RootHash()
+}
+
+// Commit merges the branch updates produced by AccountsIntermediateRoot into
+// w.commitment via branchMerger and returns the resulting root hash
+// unchanged. This is the third of the three CommitmentUpdates stages.
+func (w *Update4ReadWriter) Commit(rh []byte, branches map[string]commitment.BranchData) ([]byte, error) {
 	for k, update := range branches {
 		//w.commitment.Set(k, b)
 		prefix := []byte(k)
@@ -438,12 +800,34 @@ func (w *Update4ReadWriter) CommitmentUpdates() ([]byte, error) {
 	return rh, nil
 }
 
+// CommitmentUpdates returns the commitment updates for the current state of w.updates.
+// Commitment is based on sharedDomains commitment tree
+// All branch changes are stored inside Update4ReadWriter in commitment map.
+// Those updates got priority over sharedDomains commitment updates.
+//
+// It is a thin wrapper around Finalise, AccountsIntermediateRoot and Commit,
+// kept for callers that don't need to pipeline the three stages themselves.
+// The stages are exposed so a caller can run them one at a time. All three
+// use w's state (Finalise reads w.updates, Commit reads w.domains through
+// branchFn), and w.domains cannot be driven from more than one goroutine at
+// a time, so the stages of one Update4ReadWriter must not run concurrently
+// and there is no parallelism within or across them here.
+func (w *Update4ReadWriter) CommitmentUpdates() ([]byte, error) {
+	batch := w.Finalise()
+	rh, branches, err := w.AccountsIntermediateRoot(batch)
+	if err != nil {
+		return nil, err
+	}
+	return w.Commit(rh, branches)
+}
+
 func (w *Update4ReadWriter) WriteAccountStorage(address common.Address, incarnation uint64, key *common.Hash, original, value *uint256.Int) error {
 	if original.Eq(value) {
 		return nil
 	}
 	//fmt.Printf("storage [%x] [%x] => [%x], txNum: %d\n", address, *key, v, w.txNum)
 	//w.updates.TouchPlainKey(common.Append(address[:], key[:]), value.Bytes(), w.updates.TouchStorage)
+	w.recordUpdate4Journal(common.Append(address[:], key[:]), update4TouchStorage)
 	w.updates.TouchPlainKeyDom(w.domains, common.Append(address[:], key[:]), value.Bytes(), w.updates.TouchStorage)
 	return nil
 }
@@ -474,6 +858,7 @@ func (w *Update4ReadWriter) ReadAccountData(address common.Address) (*accounts.A
 
 	upd := ci.Update()
 	w.reads = append(w.reads, upd)
+	w.recordRead(address.Bytes(), upd)
 	return UpdateToAccount(upd), nil
 }
 
@@ -484,6 +869,7 @@ func (w *Update4ReadWriter) ReadAccountStorage(address common.Address, incarnati
 	}
 	upd := ci.Update()
 	w.reads = append(w.reads, upd)
+	w.recordRead(common.Append(address.Bytes(), key.Bytes()), upd)
 
 	if upd.ValLength > 0 {
 		return upd.CodeHashOrStorage[:upd.ValLength], nil
@@ -498,6 +884,7 @@ func (w *Update4ReadWriter) ReadAccountCode(address common.Address, incarnation
 	}
 	upd := ci.Update()
 	w.reads = append(w.reads, upd)
+	w.recordRead(address.Bytes(), upd)
 	if upd.ValLength > 0 {
 		return upd.CodeHashOrStorage[:upd.ValLength], nil
 	}
@@ -514,4 +901,4 @@ func (w *Update4ReadWriter) ReadAccountCodeSize(address common.Address, incarnat
 
 func (w *Update4ReadWriter) ReadAccountIncarnation(address common.Address) (uint64, error) {
 	return 0, nil
-}
\ No newline at end of file
+}
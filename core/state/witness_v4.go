@@ -0,0 +1,146 @@
+package state
+
+import (
+	"errors"
+
+	"github.com/ledgerwatch/erigon-lib/commitment"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon/core/types/accounts"
+	"github.com/ledgerwatch/erigon/rlp"
+)
+
+var errWitnessNotEnabled = errors.New("rw_v4: EnableWitness was not called before Witness")
+
+// WitnessNodeKind identifies what a WitnessNode's Raw bytes encode, so a
+// stateless verifier knows how to re-hash it while replaying the trie.
+type WitnessNodeKind uint8
+
+const (
+	WitnessBranchNode WitnessNodeKind = iota
+	WitnessAccountLeaf
+	WitnessStorageLeaf
+	WitnessCodeBinding
+)
+
+// WitnessNode is one touched trie node recorded while CommitmentUpdates
+// walks the Hex Patricia trie, or a code binding recorded by
+// UpdateAccountCode, or a leaf recorded by a read when reads are recorded.
+type WitnessNode struct {
+	Path []byte
+	Kind WitnessNodeKind
+	Raw  []byte
+}
+
+// Witness is the RLP-encoded payload returned by Update4ReadWriter.Witness:
+// the pre-state root plus every node a stateless verifier needs to
+// re-execute the block against the Hex Patricia trie and arrive at the same
+// post-state root CommitmentUpdates returned.
+type Witness struct {
+	PreStateRoot []byte
+	Nodes        []WitnessNode
+}
+
+// witnessBuilder records every touched trie node exactly once, in the order
+// first touched, as accountFn/storageFn/branchFn are invoked.
+type witnessBuilder struct {
+	recordReads bool
+
+	preStateRoot []byte
+	seen         map[string]struct{}
+	nodes        []WitnessNode
+}
+
+func newWitnessBuilder(recordReads bool) *witnessBuilder {
+	return &witnessBuilder{recordReads: recordReads, seen: make(map[string]struct{})}
+}
+
+func (b *witnessBuilder) record(kind WitnessNodeKind, path, raw []byte) {
+	key := string(append([]byte{byte(kind)}, path...))
+	if _, ok := b.seen[key]; ok {
+		return
+	}
+	b.seen[key] = struct{}{}
+	b.nodes = append(b.nodes, WitnessNode{Path: append([]byte(nil), path...), Kind: kind, Raw: append([]byte(nil), raw...)})
+}
+
+// EnableWitness switches w into witness-building mode: every account leaf,
+// storage leaf and branch node touched by a subsequent CommitmentUpdates (or
+// its Finalise/AccountsIntermediateRoot/Commit stages), and every
+// code→code-hash binding passed to a subsequent UpdateAccountCode, is
+// recorded into an ordered, deduplicated stream. Pass
+// recordReads to also capture BALANCE/EXTCODEHASH-style accesses that read
+// w.updates without mutating it.
+func (w *Update4ReadWriter) EnableWitness(recordReads bool) error {
+	rootHash, err := w.loadPatriciaState()
+	if err != nil {
+		return err
+	}
+	w.witness = newWitnessBuilder(recordReads)
+	w.witness.preStateRoot = rootHash
+	return nil
+}
+
+// Witness returns the RLP-encoded witness accumulated since EnableWitness
+// was called. It returns an error if witness recording was never enabled.
+func (w *Update4ReadWriter) Witness() ([]byte, error) {
+	if w.witness == nil {
+		return nil, errWitnessNotEnabled
+	}
+	return rlp.EncodeToBytes(&Witness{PreStateRoot: w.witness.preStateRoot, Nodes: w.witness.nodes})
+}
+
+// recordAccountWitness captures the account leaf cell produced by accountFn
+// after domains.AccountFn has populated it.
+func (w *Update4ReadWriter) recordAccountWitness(plainKey []byte, cell *commitment.Cell) {
+	if w.witness == nil {
+		return
+	}
+	acc := accounts.NewAccount()
+	acc.Initialised = true
+	acc.Nonce = cell.Nonce
+	acc.Balance.Set(&cell.Balance)
+	acc.CodeHash = cell.CodeHash
+	w.witness.record(WitnessAccountLeaf, plainKey, accounts.SerialiseV3(&acc))
+}
+
+// recordStorageWitness captures the storage leaf cell produced by storageFn
+// after domains.StorageFn has populated it.
+func (w *Update4ReadWriter) recordStorageWitness(plainKey []byte, cell *commitment.Cell) {
+	if w.witness == nil {
+		return
+	}
+	w.witness.record(WitnessStorageLeaf, plainKey, cell.Storage[:cell.StorageLen])
+}
+
+// recordBranchWitness captures a branch node as returned by branchFn, be it
+// served from w.commitment or from the underlying domains.
+func (w *Update4ReadWriter) recordBranchWitness(key, raw []byte) {
+	if w.witness == nil {
+		return
+	}
+	w.witness.record(WitnessBranchNode, key, raw)
+}
+
+// recordCodeWitness captures the code→code-hash binding touched by
+// UpdateAccountCode.
+func (w *Update4ReadWriter) recordCodeWitness(codeHash, code []byte) {
+	if w.witness == nil {
+		return
+	}
+	w.witness.record(WitnessCodeBinding, codeHash, code)
+}
+
+// recordRead captures a BALANCE/EXTCODEHASH-style access that only reads
+// w.updates without mutating it, when EnableWitness(recordReads=true).
+func (w *Update4ReadWriter) recordRead(plainKey []byte, upd commitment.Update) {
+	if w.witness == nil || !w.witness.recordReads {
+		return
+	}
+	if len(plainKey) > length.Addr {
+		w.witness.record(WitnessStorageLeaf, plainKey, upd.CodeHashOrStorage[:upd.ValLength])
+		return
+	}
+	// Account leaves carry the serialised account, as recordAccountWitness
+	// does, so an EOA read (no code hash) is recorded too.
+	w.witness.record(WitnessAccountLeaf, plainKey, accounts.SerialiseV3(UpdateToAccount(upd)))
+}